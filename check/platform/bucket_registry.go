@@ -0,0 +1,202 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/beck-8/subs-check/config"
+	"github.com/juju/ratelimit"
+)
+
+// BucketRegistry 按 (订阅来源, 代理节点) 懒加载分层令牌桶：全局桶、按来源桶、按节点桶，
+// 在每次 Read 读到数据后按读到的字节数依次消费，防止单个订阅在批量测速时占满带宽，同时给运营者提供不超过 ISP 限速的手段。
+type BucketRegistry struct {
+	mu sync.Mutex
+
+	global    *limiterBucket
+	perSource map[string]*limiterBucket
+	perNode   map[string]*limiterBucket
+}
+
+// limiterBucket 组合了 ratelimit.Bucket 和用于 /api/limiter/stats 展示的累计字节数
+type limiterBucket struct {
+	bucket          *ratelimit.Bucket
+	cumulativeBytes uint64
+}
+
+// NewBucketRegistry 创建一个空的分层令牌桶注册表，具体的桶在首次被引用时才会创建
+func NewBucketRegistry() *BucketRegistry {
+	return &BucketRegistry{
+		perSource: make(map[string]*limiterBucket),
+		perNode:   make(map[string]*limiterBucket),
+	}
+}
+
+// Buckets 返回 source/node 对应的全局桶、来源桶、节点桶，按需懒加载；速率为 0 时对应层不限速（返回 nil）
+func (r *BucketRegistry) Buckets(source, node string) (global, perSource, perNode *ratelimit.Bucket) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if config.GlobalConfig.GlobalDownloadKBs > 0 {
+		if r.global == nil {
+			r.global = newLimiterBucket(config.GlobalConfig.GlobalDownloadKBs)
+		}
+		global = r.global.bucket
+	}
+
+	if config.GlobalConfig.PerSourceDownloadKBs > 0 {
+		lb, ok := r.perSource[source]
+		if !ok {
+			lb = newLimiterBucket(config.GlobalConfig.PerSourceDownloadKBs)
+			r.perSource[source] = lb
+		}
+		perSource = lb.bucket
+	}
+
+	if config.GlobalConfig.PerNodeDownloadKBs > 0 {
+		key := source + "\x00" + node
+		lb, ok := r.perNode[key]
+		if !ok {
+			lb = newLimiterBucket(config.GlobalConfig.PerNodeDownloadKBs)
+			r.perNode[key] = lb
+		}
+		perNode = lb.bucket
+	}
+
+	return global, perSource, perNode
+}
+
+func newLimiterBucket(kbs int) *limiterBucket {
+	return &limiterBucket{
+		bucket: ratelimit.NewBucketWithRate(float64(kbs)*1024, int64(kbs)*1024),
+	}
+}
+
+// recordBytes 在一次读取消耗令牌后记录累计字节数，用于 /api/limiter/stats 展示
+func (r *BucketRegistry) recordBytes(source, node string, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.global != nil {
+		atomic.AddUint64(&r.global.cumulativeBytes, uint64(n))
+	}
+	if lb, ok := r.perSource[source]; ok {
+		atomic.AddUint64(&lb.cumulativeBytes, uint64(n))
+	}
+	if lb, ok := r.perNode[source+"\x00"+node]; ok {
+		atomic.AddUint64(&lb.cumulativeBytes, uint64(n))
+	}
+}
+
+// statsConn 是带分层限速与字节计数的 net.Conn 包装，在每次 Read 后依次消费全局/来源/节点三级令牌桶
+type statsConn struct {
+	net.Conn
+	registry     *BucketRegistry
+	source       string
+	node         string
+	bytesCounter *uint64
+}
+
+// newStatsConn 包装一个底层连接，使其按 (source, node) 受分层令牌桶限速并计入 bytesCounter
+func newStatsConn(conn net.Conn, registry *BucketRegistry, source, node string, bytesCounter *uint64) net.Conn {
+	return &statsConn{Conn: conn, registry: registry, source: source, node: node, bytesCounter: bytesCounter}
+}
+
+func (c *statsConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if c.bytesCounter != nil {
+			atomic.AddUint64(c.bytesCounter, uint64(n))
+		}
+		if c.registry != nil {
+			global, perSource, perNode := c.registry.Buckets(c.source, c.node)
+			if global != nil {
+				global.Wait(int64(n))
+			}
+			if perSource != nil {
+				perSource.Wait(int64(n))
+			}
+			if perNode != nil {
+				perNode.Wait(int64(n))
+			}
+			c.registry.recordBytes(c.source, c.node, int64(n))
+		}
+	}
+	return n, err
+}
+
+// WrapTransport 返回一个包装过的 RoundTripper：通过它建立的每个连接都会用 newStatsConn 包装，
+// 在每次 Read 时计入 bytesCounter，并在 r 非 nil 时依次消费 (source, node) 对应的全局/来源/
+// 节点三级令牌桶，这样分层限速才会真正作用到测速实际发生的网络读取上，而不是只停留在配置里。
+// r 为 nil 时可安全调用：字节计数仍然生效，只是跳过令牌桶限速，调用方无需先判空再决定是否
+// 包装——bytesCounter 的计数不应该依赖这个功能是否开启。
+// rt 不是可克隆的 *http.Transport 时原样返回，调用方应当视为限速未生效。
+func (r *BucketRegistry) WrapTransport(rt http.RoundTripper, source, node string, bytesCounter *uint64) http.RoundTripper {
+	base, ok := rt.(*http.Transport)
+	if !ok || base == nil {
+		return rt
+	}
+
+	clone := base.Clone()
+	dial := base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	clone.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newStatsConn(conn, r, source, node, bytesCounter), nil
+	}
+	return clone
+}
+
+// RegisterRoutes 把 GET /api/limiter/stats 挂载到给定的 mux 上，供运营者查看各级令牌桶状态
+func (r *BucketRegistry) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/limiter/stats", r.LimiterStatsHandler)
+}
+
+// limiterStatsEntry 是 /api/limiter/stats 返回的单个桶的状态
+type limiterStatsEntry struct {
+	AvailableKBs    int64  `json:"available_kbs"`
+	CumulativeBytes uint64 `json:"cumulative_bytes"`
+}
+
+// Stats 汇总当前已创建的全局、各来源、各节点令牌桶的可用令牌数和累计字节数
+func (r *BucketRegistry) Stats() map[string]limiterStatsEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]limiterStatsEntry)
+	if r.global != nil {
+		stats["global"] = limiterStatsEntry{
+			AvailableKBs:    r.global.bucket.Available() / 1024,
+			CumulativeBytes: atomic.LoadUint64(&r.global.cumulativeBytes),
+		}
+	}
+	for source, lb := range r.perSource {
+		stats[fmt.Sprintf("source:%s", source)] = limiterStatsEntry{
+			AvailableKBs:    lb.bucket.Available() / 1024,
+			CumulativeBytes: atomic.LoadUint64(&lb.cumulativeBytes),
+		}
+	}
+	for key, lb := range r.perNode {
+		stats[fmt.Sprintf("node:%s", key)] = limiterStatsEntry{
+			AvailableKBs:    lb.bucket.Available() / 1024,
+			CumulativeBytes: atomic.LoadUint64(&lb.cumulativeBytes),
+		}
+	}
+	return stats
+}
+
+// LimiterStatsHandler 是 GET /api/limiter/stats 的处理函数，返回各级令牌桶的当前可用令牌与累计字节数
+func (r *BucketRegistry) LimiterStatsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Stats())
+}
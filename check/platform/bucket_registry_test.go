@@ -0,0 +1,89 @@
+package platform
+
+import (
+	"testing"
+
+	"github.com/beck-8/subs-check/config"
+)
+
+func withLimiterConfig(t *testing.T, global, perSource, perNode int) {
+	t.Helper()
+	prev := config.GlobalConfig
+	config.GlobalConfig.GlobalDownloadKBs = global
+	config.GlobalConfig.PerSourceDownloadKBs = perSource
+	config.GlobalConfig.PerNodeDownloadKBs = perNode
+	t.Cleanup(func() { config.GlobalConfig = prev })
+}
+
+func TestBucketRegistry_DisabledWhenRateIsZero(t *testing.T) {
+	withLimiterConfig(t, 0, 0, 0)
+
+	r := NewBucketRegistry()
+	global, perSource, perNode := r.Buckets("source-a", "node-a")
+	if global != nil || perSource != nil || perNode != nil {
+		t.Fatalf("expected all buckets nil when rates are 0, got global=%v perSource=%v perNode=%v", global, perSource, perNode)
+	}
+}
+
+func TestBucketRegistry_LazyCreationIsIdempotent(t *testing.T) {
+	withLimiterConfig(t, 1000, 500, 100)
+
+	r := NewBucketRegistry()
+	global1, perSource1, perNode1 := r.Buckets("source-a", "node-a")
+	if global1 == nil || perSource1 == nil || perNode1 == nil {
+		t.Fatalf("expected all buckets to be created when rates are positive")
+	}
+
+	global2, perSource2, perNode2 := r.Buckets("source-a", "node-a")
+	if global1 != global2 {
+		t.Errorf("global bucket should be reused across calls")
+	}
+	if perSource1 != perSource2 {
+		t.Errorf("per-source bucket should be reused for the same source")
+	}
+	if perNode1 != perNode2 {
+		t.Errorf("per-node bucket should be reused for the same (source, node)")
+	}
+}
+
+func TestBucketRegistry_PerSourceAndPerNodeAreIsolated(t *testing.T) {
+	withLimiterConfig(t, 1000, 500, 100)
+
+	r := NewBucketRegistry()
+	global1, perSource1, perNode1 := r.Buckets("source-a", "node-a")
+	global2, perSource2, perNode2 := r.Buckets("source-a", "node-b")
+	_, perSource3, _ := r.Buckets("source-b", "node-a")
+
+	if global1 != global2 {
+		t.Errorf("global bucket should be shared across all sources/nodes")
+	}
+	if perSource1 != perSource2 {
+		t.Errorf("per-source bucket should be shared across nodes of the same source")
+	}
+	if perNode1 == perNode2 {
+		t.Errorf("per-node bucket should differ between distinct nodes of the same source")
+	}
+	if perSource1 == perSource3 {
+		t.Errorf("per-source bucket should differ between distinct sources")
+	}
+}
+
+func TestBucketRegistry_StatsTracksCumulativeBytes(t *testing.T) {
+	withLimiterConfig(t, 1000, 500, 100)
+
+	r := NewBucketRegistry()
+	r.Buckets("source-a", "node-a")
+	r.recordBytes("source-a", "node-a", 2048)
+	r.recordBytes("source-a", "node-a", 1024)
+
+	stats := r.Stats()
+	if got := stats["global"].CumulativeBytes; got != 3072 {
+		t.Errorf("global cumulative bytes = %d, want 3072", got)
+	}
+	if got := stats["source:source-a"].CumulativeBytes; got != 3072 {
+		t.Errorf("per-source cumulative bytes = %d, want 3072", got)
+	}
+	if got := stats["node:source-a\x00node-a"].CumulativeBytes; got != 3072 {
+		t.Errorf("per-node cumulative bytes = %d, want 3072", got)
+	}
+}
@@ -1,19 +1,33 @@
 package platform
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"log/slog"
 
+	"github.com/VividCortex/ewma"
 	"github.com/beck-8/subs-check/config"
-	"github.com/juju/ratelimit"
+	"github.com/gorilla/websocket"
 	"github.com/metacubex/mihomo/common/convert"
 )
 
+// ErrBelowMinSpeed 表示测速过程中下载速度低于 MinSpeedKBs，请求已被提前取消
+var ErrBelowMinSpeed = errors.New("speed below MinSpeedKBs, aborted early")
+
+// ErrBufferbloat 表示负载下延迟（bufferbloat）超过 MaxLoadedRttMs 或 MaxRttInflationRatio 阈值
+var ErrBufferbloat = errors.New("loaded latency exceeds bufferbloat threshold")
+
 // networkLimitedReader 基于网络层字节计数器的大小限制 reader
 type networkLimitedReader struct {
 	reader       io.Reader
@@ -39,17 +53,21 @@ func (r *networkLimitedReader) Read(p []byte) (n int, err error) {
 	return r.reader.Read(p)
 }
 
-func CheckSpeed(httpClient *http.Client, bucket *ratelimit.Bucket, bytesCounter *uint64) (int, int64, error) {
+func CheckSpeed(ctx context.Context, httpClient *http.Client, registry *BucketRegistry, source, node string, bytesCounter *uint64) (int, int64, error) {
 	// 注意：速度限制在网络层（statsConn）实现，大小限制在应用层基于网络字节计数器实现
-	// - 速度限制：通过 bucket 在 statsConn 中实现（网络层）
+	// - 速度限制：通过 registry 按 (source, node) 懒加载的分层 ratelimit.Bucket 在 statsConn 中实现（网络层）
 	// - 大小限制：通过 networkLimitedReader 基于网络字节计数器实现（应用层，但限制网络流量）
+	//
+	// WrapTransport 的字节计数必须无条件接入：registry 为 nil 只代表"不限速"，
+	// bytesCounter 的计数与限速是否生效无关，DownloadMB/MinSpeedKBs 都依赖它才能工作
+	transport := registry.WrapTransport(httpClient.Transport, source, node, bytesCounter)
 
 	// 创建一个新的测速专用客户端，基于原有客户端的传输层
 	speedClient := &http.Client{
 		// 设置更长的超时时间用于测速
 		Timeout: time.Duration(config.GlobalConfig.DownloadTimeout) * time.Second,
-		// 保持原有的传输层配置
-		Transport: httpClient.Transport,
+		// 使用（可能已按分层令牌桶包装过的）传输层
+		Transport: transport,
 	}
 
 	req, err := http.NewRequest("GET", config.GlobalConfig.SpeedTestUrl, nil)
@@ -58,6 +76,13 @@ func CheckSpeed(httpClient *http.Client, bucket *ratelimit.Bucket, bytesCounter
 	}
 	req.Header.Set("User-Agent", convert.RandUserAgent())
 
+	// 在调用方传入的 ctx 基础上绑定可取消的子 context，使其既能响应调用方的取消/超时，
+	// 又能在低于最小速度时被 watchMinSpeed 提前终止
+	parentCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
+
 	// 记录测速前的网络传输字节数
 	var startBytes uint64
 	if bytesCounter != nil {
@@ -88,8 +113,39 @@ func CheckSpeed(httpClient *http.Client, bucket *ratelimit.Bucket, bytesCounter
 		limit:        limitSize,
 	}
 
+	// 低于 MinSpeedKBs 时提前终止：预热期过后，若移动平均速度持续低于阈值则取消请求
+	var stopWatch chan struct{}
+	if config.GlobalConfig.MinSpeedKBs > 0 && bytesCounter != nil {
+		stopWatch = make(chan struct{})
+		go watchMinSpeed(cancel, bytesCounter, startBytes, stopWatch)
+	}
+
 	// 读取所有数据
 	totalBytes, err := io.Copy(io.Discard, limitedReader)
+	if stopWatch != nil {
+		close(stopWatch)
+	}
+
+	// 只有当 io.Copy 本身因 context 取消而中断时，才是 watchMinSpeed 真正生效提前终止了下载；
+	// 若 copy 已经正常结束（EOF/达到大小限制）之后 cancel 才被调用，ctx.Err() 仍会是 Canceled，
+	// 但这不代表下载被打断，因此必须看 io.Copy 返回的错误本身，而不是事后检查 ctx.Err()
+	if err != nil && errors.Is(err, context.Canceled) {
+		// 调用方自己的 ctx 被取消、或未启用 watchMinSpeed 时，不是低速终止，原样返回错误
+		if parentCtx.Err() != nil || stopWatch == nil {
+			return 0, 0, err
+		}
+		duration := time.Since(startTime).Milliseconds()
+		if duration == 0 {
+			duration = 1
+		}
+		var actualBytes int64
+		if bytesCounter != nil {
+			actualBytes = int64(*bytesCounter - startBytes)
+		}
+		speed := int(float64(actualBytes) / 1024 * 1000 / float64(duration))
+		return speed, actualBytes, ErrBelowMinSpeed
+	}
+
 	// io.EOF 是正常的（达到限制），其他错误才需要关注
 	if err != nil && err != io.EOF && totalBytes == 0 {
 		slog.Debug(fmt.Sprintf("totalBytes: %d, 读取数据时发生错误: %v", totalBytes, err))
@@ -116,3 +172,650 @@ func CheckSpeed(httpClient *http.Client, bucket *ratelimit.Bucket, bytesCounter
 
 	return speed, actualBytes, nil
 }
+
+// watchMinSpeed 每 500ms 采样一次网络字节计数器，预热期（SpeedTestWarmupMs）过后
+// 若 EWMA 平滑速度低于 MinSpeedKBs 则调用 cancel 提前终止请求
+func watchMinSpeed(cancel context.CancelFunc, bytesCounter *uint64, startBytes uint64, stop <-chan struct{}) {
+	warmup := time.Duration(config.GlobalConfig.SpeedTestWarmupMs) * time.Millisecond
+	if warmup <= 0 {
+		warmup = 2000 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	start := time.Now()
+	// 权重 0.5 的 EWMA，首个采样直接作为初值，预热期结束时已有可用的平滑值
+	var avg float64
+	var haveAvg bool
+	var lastBytes uint64
+	lastTime := start
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			current := atomic.LoadUint64(bytesCounter) - startBytes
+			elapsed := now.Sub(lastTime).Seconds()
+			if elapsed <= 0 {
+				continue
+			}
+			kbs := float64(current-lastBytes) / 1024 / elapsed
+			if haveAvg {
+				avg = 0.5*kbs + 0.5*avg
+			} else {
+				avg = kbs
+				haveAvg = true
+			}
+			lastBytes = current
+			lastTime = now
+
+			if now.Sub(start) < warmup {
+				continue
+			}
+			if int(avg) < config.GlobalConfig.MinSpeedKBs {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// ParallelSpeedResult 多连接并发测速的聚合结果
+type ParallelSpeedResult struct {
+	SpeedKBs int   // EWMA 平滑后的稳态速度（KB/s）
+	Bytes    int64 // 所有连接累计传输的字节数
+	PeakKBs  int   // 采样区间内的峰值速度（KB/s）
+	P50KBs   int   // 采样速度的中位数（KB/s）
+	P95KBs   int   // 采样速度的 95 分位数（KB/s）
+}
+
+// CheckSpeedParallel 使用多个并发连接对 SpeedTestUrl 做 Range 分段下载测速，
+// 并用 EWMA 对整体吞吐量采样做平滑，得到更贴近多路复用客户端（如 yt-dlp/aria2）实际表现的稳态速度。
+// 如果服务端不支持 Range（Accept-Ranges: bytes），则退化为 N 个独立的完整 GET。
+func CheckSpeedParallel(httpClient *http.Client, registry *BucketRegistry, source, node string, bytesCounter *uint64) (*ParallelSpeedResult, error) {
+	connections := config.GlobalConfig.SpeedTestConnections
+	if connections <= 0 {
+		connections = 1
+	}
+
+	sampleInterval := time.Duration(config.GlobalConfig.SpeedTestSampleIntervalMs) * time.Millisecond
+	if sampleInterval <= 0 {
+		sampleInterval = 100 * time.Millisecond
+	}
+
+	// registry 为 nil 时 WrapTransport 仍然无条件接入字节计数（只是不做限速），
+	// 否则 DownloadMB 的聚合容量限制和采样吞吐量会永远基于一个不动的计数器
+	transport := registry.WrapTransport(httpClient.Transport, source, node, bytesCounter)
+
+	speedClient := &http.Client{
+		Timeout:   time.Duration(config.GlobalConfig.DownloadTimeout) * time.Second,
+		Transport: transport,
+	}
+
+	// HEAD 探测 Content-Length 和是否支持 Range
+	contentLength, acceptsRanges, err := probeContentLength(speedClient, config.GlobalConfig.SpeedTestUrl)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("测速 HEAD 探测失败: %v", err))
+	}
+
+	var limitSize uint64
+	if config.GlobalConfig.DownloadMB > 0 {
+		limitSize = uint64(config.GlobalConfig.DownloadMB) * 1024 * 1024
+	}
+
+	var startBytes uint64
+	if bytesCounter != nil {
+		startBytes = *bytesCounter
+	}
+
+	// 采样并用 EWMA 平滑整体吞吐量：age=3 对应衰减系数 2/(3+1)=0.5，
+	// 前 10 个采样点内 Value() 为 0（由下方的总量/耗时兜底）
+	avg := ewma.NewMovingAverage(3)
+	samples := make([]int, 0, 64)
+	var peak int
+	samplesMu := sync.Mutex{}
+
+	stopSampling := make(chan struct{})
+	var samplingWg sync.WaitGroup
+	samplingWg.Add(1)
+	go func() {
+		defer samplingWg.Done()
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		var lastBytes uint64
+		var lastTime = time.Now()
+		for {
+			select {
+			case <-stopSampling:
+				return
+			case now := <-ticker.C:
+				if bytesCounter == nil {
+					continue
+				}
+				current := atomic.LoadUint64(bytesCounter) - startBytes
+				delta := current - lastBytes
+				elapsed := now.Sub(lastTime).Seconds()
+				if elapsed <= 0 {
+					continue
+				}
+				kbs := int(float64(delta) / 1024 / elapsed)
+				avg.Add(float64(kbs))
+				samplesMu.Lock()
+				samples = append(samples, kbs)
+				if kbs > peak {
+					peak = kbs
+				}
+				samplesMu.Unlock()
+				lastBytes = current
+				lastTime = now
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	runConn := func(startOffset, endOffset int64, useRange bool) {
+		defer wg.Done()
+		req, err := http.NewRequest("GET", config.GlobalConfig.SpeedTestUrl, nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("User-Agent", convert.RandUserAgent())
+		if useRange {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", startOffset, endOffset))
+		}
+
+		resp, err := speedClient.Do(req)
+		if err != nil {
+			slog.Debug(fmt.Sprintf("并发测速连接失败: %v", err))
+			return
+		}
+		defer resp.Body.Close()
+
+		// 用共享的网络字节计数器做跨连接的聚合容量限制（原子检查）
+		limitedReader := &networkLimitedReader{
+			reader:       resp.Body,
+			bytesCounter: bytesCounter,
+			startBytes:   startBytes,
+			limit:        limitSize,
+		}
+		io.Copy(io.Discard, limitedReader)
+	}
+
+	startTime := time.Now()
+	if acceptsRanges && contentLength > 0 {
+		for _, rg := range splitRanges(contentLength, connections) {
+			wg.Add(1)
+			go runConn(rg.Start, rg.End, true)
+		}
+	} else {
+		// 服务端不支持 Range，退化为 N 个独立的完整 GET
+		for i := 0; i < connections; i++ {
+			wg.Add(1)
+			go runConn(0, 0, false)
+		}
+	}
+	wg.Wait()
+	close(stopSampling)
+	samplingWg.Wait()
+
+	duration := time.Since(startTime).Milliseconds()
+	if duration == 0 {
+		duration = 1
+	}
+
+	var totalBytes int64
+	if bytesCounter != nil {
+		totalBytes = int64(*bytesCounter - startBytes)
+	}
+
+	samplesMu.Lock()
+	p50, p95 := percentiles(samples)
+	samplesMu.Unlock()
+
+	result := &ParallelSpeedResult{
+		SpeedKBs: int(avg.Value()),
+		Bytes:    totalBytes,
+		PeakKBs:  peak,
+		P50KBs:   p50,
+		P95KBs:   p95,
+	}
+	if result.SpeedKBs == 0 && totalBytes > 0 {
+		// 没有足够的采样点时，退化为总量/耗时
+		result.SpeedKBs = int(float64(totalBytes) / 1024 * 1000 / float64(duration))
+	}
+
+	return result, nil
+}
+
+// byteRange 描述一个分段下载使用的字节区间 [Start, End]（闭区间，对应 HTTP Range 头）
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// splitRanges 将 [0, contentLength) 尽量平均地切分成 connections 段，最后一段吸收余数；
+// connections<=0 按 1 处理，contentLength<=0 返回 nil，contentLength 小于 connections 时只返回覆盖全部内容的一段
+func splitRanges(contentLength int64, connections int) []byteRange {
+	if connections <= 0 {
+		connections = 1
+	}
+	if contentLength <= 0 {
+		return nil
+	}
+
+	chunk := contentLength / int64(connections)
+	if chunk <= 0 {
+		return []byteRange{{Start: 0, End: contentLength - 1}}
+	}
+
+	ranges := make([]byteRange, 0, connections)
+	for i := 0; i < connections; i++ {
+		start := int64(i) * chunk
+		end := start + chunk - 1
+		if i == connections-1 {
+			end = contentLength - 1
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+	}
+	return ranges
+}
+
+// probeContentLength 用 HEAD 请求探测目标 URL 的 Content-Length 和 Accept-Ranges 支持情况
+func probeContentLength(client *http.Client, url string) (int64, bool, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("User-Agent", convert.RandUserAgent())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	acceptsRanges := resp.Header.Get("Accept-Ranges") == "bytes"
+	return resp.ContentLength, acceptsRanges, nil
+}
+
+// percentiles 计算采样集合的 P50 和 P95
+func percentiles(samples []int) (p50 int, p95 int) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	sorted := make([]int, len(samples))
+	copy(sorted, samples)
+	sort.Ints(sorted)
+
+	idx50 := len(sorted) * 50 / 100
+	if idx50 >= len(sorted) {
+		idx50 = len(sorted) - 1
+	}
+	idx95 := len(sorted) * 95 / 100
+	if idx95 >= len(sorted) {
+		idx95 = len(sorted) - 1
+	}
+	return sorted[idx50], sorted[idx95]
+}
+
+// Result 是各 SpeedTester 后端统一返回的测速结果
+type Result struct {
+	Backend          string            // 后端名称："http"、"msak"、"librespeed"
+	Bytes            int64             // 本次测速实际传输的字节数
+	Elapsed          time.Duration     // 本次测速耗时
+	SpeedKBs         int               // 速度（KB/s）：仅 http 后端在 SpeedTestConnections>1 且采样点足够时为 EWMA 平滑值，其余情况为实际传输字节数/耗时，不做平滑
+	LatencyUnderLoad *LatencyUnderLoad // 负载下延迟（bufferbloat）测量结果，探测失败时为 nil
+}
+
+// LatencyUnderLoad 描述空闲延迟与下载过程中负载延迟的对比，用于识别 bufferbloat 严重的节点
+type LatencyUnderLoad struct {
+	IdleRttMs      int     // 下载开始前的空闲 RTT 中位数（毫秒）
+	LoadedRttMs    int     // 下载过程中的负载 RTT 中位数（毫秒）
+	InflationRatio float64 // LoadedRttMs / IdleRttMs
+}
+
+// SpeedTester 是可插拔的测速协议后端
+type SpeedTester interface {
+	Run(ctx context.Context, httpClient *http.Client, registry *BucketRegistry, source, node string, bytesCounter *uint64) (Result, error)
+}
+
+// NewSpeedTester 根据 config.GlobalConfig.SpeedTestBackend 选择测速后端，默认使用 http
+func NewSpeedTester() SpeedTester {
+	switch strings.ToLower(config.GlobalConfig.SpeedTestBackend) {
+	case "msak", "ws", "ndt7":
+		return &wsSpeedTester{}
+	case "librespeed":
+		return &libreSpeedTester{}
+	default:
+		return &httpSpeedTester{}
+	}
+}
+
+// RunSpeedTest 按配置选择的后端执行一次测速
+func RunSpeedTest(ctx context.Context, httpClient *http.Client, registry *BucketRegistry, source, node string, bytesCounter *uint64) (Result, error) {
+	return NewSpeedTester().Run(ctx, httpClient, registry, source, node, bytesCounter)
+}
+
+// httpSpeedTester 是默认后端，复用现有的 HTTP GET 测速逻辑
+type httpSpeedTester struct{}
+
+func (t *httpSpeedTester) Run(ctx context.Context, httpClient *http.Client, registry *BucketRegistry, source, node string, bytesCounter *uint64) (Result, error) {
+	probeURL := config.GlobalConfig.LatencyProbeUrl
+	if probeURL == "" {
+		probeURL = config.GlobalConfig.SpeedTestUrl
+	}
+
+	// 延迟探测必须走独立的字节计数器：bytesCounter 是 CheckSpeed 里 networkLimitedReader
+	// 用来做 DownloadMB 容量上限判断的计数器，如果探测请求也往这个计数器里记账，会在下载
+	// 仍在进行时偷走它的容量预算，导致实际测速提前被限速截断。探测流量只计入 probeCounter。
+	var probeCounter uint64
+	probeClient := buildProbeClient(httpClient, &probeCounter)
+
+	idleRttMs := medianRtt(probeClient, probeURL, 5)
+
+	var loadedSamples []int
+	var loadedMu sync.Mutex
+	stopProbe := make(chan struct{})
+	var probeWg sync.WaitGroup
+	probeWg.Add(1)
+	go func() {
+		defer probeWg.Done()
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopProbe:
+				return
+			case <-ticker.C:
+				if rttMs, ok := probeRtt(probeClient, probeURL); ok {
+					loadedMu.Lock()
+					loadedSamples = append(loadedSamples, rttMs)
+					loadedMu.Unlock()
+				}
+			}
+		}
+	}()
+
+	// SpeedTestConnections>1 时使用 CheckSpeedParallel 做多连接 Range 分段下载 + EWMA 平滑吞吐量，
+	// 否则沿用单连接的 CheckSpeed；两者共享同一个 bytesCounter/DownloadMB 容量上限语义
+	var speed int
+	var bytes int64
+	var err error
+	speedStart := time.Now()
+	if config.GlobalConfig.SpeedTestConnections > 1 {
+		var parallelResult *ParallelSpeedResult
+		parallelResult, err = CheckSpeedParallel(httpClient, registry, source, node, bytesCounter)
+		if parallelResult != nil {
+			speed = parallelResult.SpeedKBs
+			bytes = parallelResult.Bytes
+		}
+	} else {
+		speed, bytes, err = CheckSpeed(ctx, httpClient, registry, source, node, bytesCounter)
+	}
+	elapsed := time.Since(speedStart)
+	close(stopProbe)
+	probeWg.Wait()
+
+	result := Result{Backend: "http", Bytes: bytes, Elapsed: elapsed, SpeedKBs: speed}
+
+	loadedMu.Lock()
+	samples := loadedSamples
+	loadedMu.Unlock()
+	if idleRttMs > 0 && len(samples) > 0 {
+		loadedRttMs, _ := percentiles(samples)
+		lul := &LatencyUnderLoad{
+			IdleRttMs:      idleRttMs,
+			LoadedRttMs:    loadedRttMs,
+			InflationRatio: float64(loadedRttMs) / float64(idleRttMs),
+		}
+		result.LatencyUnderLoad = lul
+
+		if err == nil {
+			if config.GlobalConfig.MaxLoadedRttMs > 0 && lul.LoadedRttMs > config.GlobalConfig.MaxLoadedRttMs {
+				err = ErrBufferbloat
+			} else if config.GlobalConfig.MaxRttInflationRatio > 0 && lul.InflationRatio > config.GlobalConfig.MaxRttInflationRatio {
+				err = ErrBufferbloat
+			}
+		}
+	}
+
+	return result, err
+}
+
+// probeRtt 通过 Range=0-0 发起一次极小请求测量一次往返延迟，返回耗时（毫秒）
+func probeRtt(httpClient *http.Client, probeURL string) (rttMs int, ok bool) {
+	req, err := http.NewRequest("GET", probeURL, nil)
+	if err != nil {
+		return 0, false
+	}
+	req.Header.Set("User-Agent", convert.RandUserAgent())
+	req.Header.Set("Range", "bytes=0-0")
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return int(time.Since(start).Milliseconds()), true
+}
+
+// medianRtt 在下载开始前采集 n 次空闲 RTT 样本并返回中位数（毫秒）
+func medianRtt(httpClient *http.Client, probeURL string, n int) int {
+	samples := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		if rttMs, ok := probeRtt(httpClient, probeURL); ok {
+			samples = append(samples, rttMs)
+		}
+	}
+	p50, _ := percentiles(samples)
+	return p50
+}
+
+// buildProbeClient 为延迟探测构造一个独立的 http.Client：复用底层代理 Transport 拨号，
+// 但把读取到的字节计入 probeCounter 而不是调用方用于 DownloadMB 判断的计数器，使探测
+// 流量不会挤占测速的容量预算。如果 Transport 不是可克隆的 *http.Transport，原样返回。
+func buildProbeClient(base *http.Client, probeCounter *uint64) *http.Client {
+	transport, ok := base.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		return base
+	}
+
+	clone := transport.Clone()
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	clone.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newStatsConn(conn, nil, "", "", probeCounter), nil
+	}
+
+	return &http.Client{Timeout: base.Timeout, Transport: clone}
+}
+
+// wsSpeedTester 通过 WebSocket 连接 M-Lab msak/ndt7 兼容的服务端（ws(s)://host/throughput/v1/download）
+// 持续读取二进制帧直到达到字节或时间预算。复用代理的 Transport.DialContext 拨号，确保流量仍经过代理。
+type wsSpeedTester struct{}
+
+func (t *wsSpeedTester) Run(ctx context.Context, httpClient *http.Client, registry *BucketRegistry, source, node string, bytesCounter *uint64) (Result, error) {
+	// 帧读取循环只看字节预算和调用方 ctx 是不够的：trickle 式的服务端可能既不达到 DownloadMB
+	// 也不主动断开连接。这里用 DownloadTimeout 派生一个有时限的子 context，确保时间预算也生效
+	if config.GlobalConfig.DownloadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.GlobalConfig.DownloadTimeout)*time.Second)
+		defer cancel()
+	}
+
+	target := config.GlobalConfig.SpeedTestUrl
+	u, err := url.Parse(target)
+	if err != nil {
+		return Result{Backend: "msak"}, err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/throughput/v1/download"
+	}
+
+	// httpClient.Transport 必须是可以确认会经过代理拨号的 *http.Transport，否则直接用
+	// websocket.Dialer 的默认拨号会绕开代理、把别的机器的带宽错记到这个节点头上。
+	// 无法确认时宁可退化到 http 后端，也不能静默绕过代理。
+	transport, ok := httpClient.Transport.(*http.Transport)
+	if !ok || transport == nil || transport.DialContext == nil {
+		slog.Warn("msak 测速后端无法确认 Transport.DialContext 会经过代理，为避免绕过代理改用 http 后端")
+		return (&httpSpeedTester{}).Run(ctx, httpClient, registry, source, node, bytesCounter)
+	}
+	// 字节计数要无条件接入：registry 为 nil 只代表不做分层限速，newStatsConn/statsConn.Read
+	// 在 registry 为 nil 时仍会计入 bytesCounter，只是跳过令牌桶 Wait，watchMinSpeed 和
+	// DownloadMB 都依赖这个计数器持续推进才能工作
+	innerDial := transport.DialContext
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := innerDial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newStatsConn(conn, registry, source, node, bytesCounter), nil
+	}
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: time.Duration(config.GlobalConfig.DownloadTimeout) * time.Second,
+		NetDialContext:   dial,
+	}
+
+	var startBytes uint64
+	if bytesCounter != nil {
+		startBytes = *bytesCounter
+	}
+
+	conn, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("msak 测速 WebSocket 连接失败: %v", err))
+		return Result{Backend: "msak"}, err
+	}
+	defer conn.Close()
+	// ReadMessage 不感知 ctx：把 ctx 的截止时间设为读超时，阻塞中的读取也会在时间预算到期时返回
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	var limitSize uint64
+	if config.GlobalConfig.DownloadMB > 0 {
+		limitSize = uint64(config.GlobalConfig.DownloadMB) * 1024 * 1024
+	}
+
+	startTime := time.Now()
+readLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			break readLoop
+		default:
+		}
+		if limitSize > 0 && bytesCounter != nil && atomic.LoadUint64(bytesCounter)-startBytes >= limitSize {
+			break
+		}
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+
+	elapsed := time.Since(startTime)
+	var actualBytes int64
+	if bytesCounter != nil {
+		actualBytes = int64(*bytesCounter - startBytes)
+	}
+	speed := 0
+	if elapsed.Milliseconds() > 0 {
+		speed = int(float64(actualBytes) / 1024 * 1000 / float64(elapsed.Milliseconds()))
+	}
+
+	return Result{Backend: "msak", Bytes: actualBytes, Elapsed: elapsed, SpeedKBs: speed}, nil
+}
+
+// libreSpeedTester 请求 LibreSpeed 兼容服务端的 garbage.php?ckSize=N 端点获取随机数据做下载测速
+type libreSpeedTester struct{}
+
+func (t *libreSpeedTester) Run(ctx context.Context, httpClient *http.Client, registry *BucketRegistry, source, node string, bytesCounter *uint64) (Result, error) {
+	// registry 为 nil 时仍需无条件接入字节计数，否则 DownloadMB 的 networkLimitedReader 永远看到一个不动的计数器
+	transport := registry.WrapTransport(httpClient.Transport, source, node, bytesCounter)
+
+	speedClient := &http.Client{
+		Timeout:   time.Duration(config.GlobalConfig.DownloadTimeout) * time.Second,
+		Transport: transport,
+	}
+
+	target := config.GlobalConfig.SpeedTestUrl
+	ckSize := config.GlobalConfig.DownloadMB
+	if ckSize <= 0 {
+		ckSize = 100
+	}
+	sep := "?"
+	if strings.Contains(target, "?") {
+		sep = "&"
+	}
+	target = fmt.Sprintf("%s%sckSize=%d", target, sep, ckSize)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return Result{Backend: "librespeed"}, err
+	}
+	req.Header.Set("User-Agent", convert.RandUserAgent())
+
+	var startBytes uint64
+	if bytesCounter != nil {
+		startBytes = *bytesCounter
+	}
+	startTime := time.Now()
+
+	resp, err := speedClient.Do(req)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("librespeed 测速请求失败: %v", err))
+		return Result{Backend: "librespeed"}, err
+	}
+	defer resp.Body.Close()
+
+	// ckSize 只是请求服务端生成的数据量，不可信：服务端可能忽略该参数或返回更多数据，
+	// 所以仍需像 CheckSpeed 一样用 networkLimitedReader 基于网络字节计数器兜底 DownloadMB 上限
+	var limitSize uint64
+	if config.GlobalConfig.DownloadMB > 0 {
+		limitSize = uint64(config.GlobalConfig.DownloadMB) * 1024 * 1024
+	}
+	limitedReader := &networkLimitedReader{
+		reader:       resp.Body,
+		bytesCounter: bytesCounter,
+		startBytes:   startBytes,
+		limit:        limitSize,
+	}
+
+	totalBytes, err := io.Copy(io.Discard, limitedReader)
+	if err != nil && err != io.EOF && totalBytes == 0 {
+		return Result{Backend: "librespeed"}, err
+	}
+
+	elapsed := time.Since(startTime)
+	var actualBytes int64
+	if bytesCounter != nil {
+		actualBytes = int64(*bytesCounter - startBytes)
+	} else {
+		actualBytes = totalBytes
+	}
+	speed := 0
+	if elapsed.Milliseconds() > 0 {
+		speed = int(float64(actualBytes) / 1024 * 1000 / float64(elapsed.Milliseconds()))
+	}
+
+	return Result{Backend: "librespeed", Bytes: actualBytes, Elapsed: elapsed, SpeedKBs: speed}, nil
+}
@@ -0,0 +1,54 @@
+package platform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPercentiles(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []int
+		wantP50 int
+		wantP95 int
+	}{
+		{"empty", nil, 0, 0},
+		{"single", []int{42}, 42, 42},
+		{"sorted", []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}, 60, 100},
+		{"unsorted", []int{100, 10, 50, 30, 90, 20, 70, 40, 80, 60}, 60, 100},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p50, p95 := percentiles(c.samples)
+			if p50 != c.wantP50 || p95 != c.wantP95 {
+				t.Errorf("percentiles(%v) = (%d, %d), want (%d, %d)", c.samples, p50, p95, c.wantP50, c.wantP95)
+			}
+		})
+	}
+}
+
+func TestSplitRanges(t *testing.T) {
+	cases := []struct {
+		name          string
+		contentLength int64
+		connections   int
+		want          []byteRange
+	}{
+		{"no content length", 0, 4, nil},
+		{"single connection", 100, 1, []byteRange{{0, 99}}},
+		{"even split", 100, 4, []byteRange{{0, 24}, {25, 49}, {50, 74}, {75, 99}}},
+		{"remainder absorbed by last segment", 10, 3, []byteRange{{0, 2}, {3, 5}, {6, 9}}},
+		{"connections <= 0 treated as 1", 50, 0, []byteRange{{0, 49}}},
+		{"more connections than bytes", 2, 5, []byteRange{{0, 1}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := splitRanges(c.contentLength, c.connections)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("splitRanges(%d, %d) = %v, want %v", c.contentLength, c.connections, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package config
+
+// Config 是 subs-check 的全局配置项。这里仅列出测速/限速相关的字段，
+// 其余业务配置（订阅源、输出格式等）由项目其他部分维护。
+type Config struct {
+	// DownloadTimeout 测速请求的超时时间（秒）
+	DownloadTimeout int `yaml:"download-timeout" mapstructure:"download-timeout"`
+	// SpeedTestUrl 测速使用的下载地址
+	SpeedTestUrl string `yaml:"speed-test-url" mapstructure:"speed-test-url"`
+	// DownloadMB 单次测速允许下载的最大数据量（MB），<=0 表示不限制
+	DownloadMB int `yaml:"download-mb" mapstructure:"download-mb"`
+
+	// SpeedTestConnections 并发测速的连接数，<=0 时视为 1
+	SpeedTestConnections int `yaml:"speed-test-connections" mapstructure:"speed-test-connections"`
+	// SpeedTestSampleIntervalMs 并发测速吞吐量采样间隔（毫秒），<=0 时默认 100ms
+	SpeedTestSampleIntervalMs int `yaml:"speed-test-sample-interval-ms" mapstructure:"speed-test-sample-interval-ms"`
+
+	// MinSpeedKBs 低于该速度（KB/s）则提前终止测速，<=0 表示不启用
+	MinSpeedKBs int `yaml:"min-speed-kbs" mapstructure:"min-speed-kbs"`
+	// SpeedTestWarmupMs 低速提前终止前的预热时间（毫秒），<=0 时默认 2000ms
+	SpeedTestWarmupMs int `yaml:"speed-test-warmup-ms" mapstructure:"speed-test-warmup-ms"`
+
+	// SpeedTestBackend 选择测速协议后端："http"（默认）、"msak"/"ws"/"ndt7"、"librespeed"
+	SpeedTestBackend string `yaml:"speed-test-backend" mapstructure:"speed-test-backend"`
+
+	// LatencyProbeUrl 负载延迟（bufferbloat）探测使用的小文件地址，留空时默认使用 SpeedTestUrl
+	LatencyProbeUrl string `yaml:"latency-probe-url" mapstructure:"latency-probe-url"`
+	// MaxLoadedRttMs 负载下 RTT 超过该值（毫秒）则判定节点失败，<=0 表示不启用该阈值
+	MaxLoadedRttMs int `yaml:"max-loaded-rtt-ms" mapstructure:"max-loaded-rtt-ms"`
+	// MaxRttInflationRatio 负载 RTT 相对空闲 RTT 的膨胀倍数超过该值则判定节点失败，<=0 表示不启用该阈值
+	MaxRttInflationRatio float64 `yaml:"max-rtt-inflation-ratio" mapstructure:"max-rtt-inflation-ratio"`
+
+	// GlobalDownloadKBs 所有测速共享的全局带宽上限（KB/s），<=0 表示不限制
+	GlobalDownloadKBs int `yaml:"global-download-kbs" mapstructure:"global-download-kbs"`
+	// PerSourceDownloadKBs 单个订阅来源的带宽上限（KB/s），<=0 表示不限制
+	PerSourceDownloadKBs int `yaml:"per-source-download-kbs" mapstructure:"per-source-download-kbs"`
+	// PerNodeDownloadKBs 单个代理节点的带宽上限（KB/s），<=0 表示不限制
+	PerNodeDownloadKBs int `yaml:"per-node-download-kbs" mapstructure:"per-node-download-kbs"`
+}
+
+// GlobalConfig 是进程内唯一的配置实例
+var GlobalConfig Config